@@ -0,0 +1,118 @@
+package tracer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// errInfoNotSupported is returned by fetchAgentInfo when the agent doesn't
+// expose /info at all (very old agents return 404 for it).
+var errInfoNotSupported = errors.New("tracer: agent does not support /info")
+
+// endpointRegistration is a trace submission endpoint the client knows how
+// to target, together with the encoder it expects on that endpoint and its
+// relative rank (see apiVersionLegacy/apiVersionStable). discoverAgent uses
+// it to pick the newest endpoint both the client and the agent support.
+type endpointRegistration struct {
+	path        string
+	encoderName string
+	apiVersion  int
+}
+
+// knownEndpoints are the trace submission endpoints this client is able to
+// target. Adding support for a new agent API version (e.g. v0.4, v0.5) is a
+// matter of registering it here and, if it needs a new wire format, with
+// RegisterEncoder. discoverAgent picks its endpoint from this table;
+// apiDowngrade does not consult it and always falls back to t.legacyURL.
+var knownEndpoints = map[string]endpointRegistration{
+	"/v0.3/traces": {path: "/v0.3/traces", encoderName: "msgpack", apiVersion: apiVersionStable},
+	"/v0.2/traces": {path: "/v0.2/traces", encoderName: "json", apiVersion: apiVersionLegacy},
+}
+
+// agentInfo is the subset of the trace agent's /info response this client
+// cares about: which trace submission endpoints it exposes.
+type agentInfo struct {
+	Endpoints []string `json:"endpoints"`
+}
+
+// discoverAgent runs at most once per Transport, guarded by t.discoverOnce:
+// it queries the agent's /info endpoint for the trace submission endpoints
+// it supports, and switches the transport to the newest one this client also
+// supports, avoiding the wasted first request and duplicated payload of the
+// reactive send/404/resend dance. If /info isn't available (very old agents
+// 404 it, or the request fails outright), the transport is left as-is and
+// falls back to the reactive downgrade handled in apiDowngrade.
+func (t *httpTransport) discoverAgent(ctx context.Context) {
+	if !t.discoveryEnabled {
+		return
+	}
+	t.discoverOnce.Do(func() {
+		info, err := t.fetchAgentInfo(ctx)
+		if err != nil {
+			log.Printf("dd-trace: agent discovery via /info unavailable, falling back to the legacy downgrade handshake: %s\n", err)
+			return
+		}
+
+		var best *endpointRegistration
+		for _, path := range info.Endpoints {
+			reg, ok := knownEndpoints[path]
+			if !ok {
+				continue
+			}
+			if best == nil || reg.apiVersion > best.apiVersion {
+				r := reg
+				best = &r
+			}
+		}
+		if best == nil {
+			return
+		}
+
+		if err := t.selectEncoder(best.encoderName); err != nil {
+			return
+		}
+		t.url = t.baseURL() + best.path
+		t.compatibilityMode = best.apiVersion < apiVersionStable
+	})
+}
+
+// fetchAgentInfo issues a single GET to the agent's /info endpoint.
+func (t *httpTransport) fetchAgentInfo(ctx context.Context) (*agentInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", t.baseURL()+"/info", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errInfoNotSupported
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("agent responded with status %d", resp.StatusCode)
+	}
+
+	var info agentInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// baseURL returns the scheme/host/port portion of t.url with the version
+// path stripped, so discoverAgent can build correctly-routed URLs for
+// whichever endpoint the agent advertises.
+func (t *httpTransport) baseURL() string {
+	if idx := strings.LastIndex(t.url, "/v0."); idx >= 0 {
+		return t.url[:idx]
+	}
+	return t.url
+}
@@ -0,0 +1,72 @@
+package tracer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDiscoverAgentSelectsNewestKnownEndpoint(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/info" {
+			t.Fatalf("unexpected request to %s", r.URL.Path)
+		}
+		w.Write([]byte(`{"endpoints":["/v0.2/traces","/v0.3/traces"]}`))
+	}))
+	defer srv.Close()
+
+	tr := newHTTPTransport(defaultHostname, defaultPort)
+	tr.url = srv.URL + "/v0.3/traces"
+	tr.legacyURL = srv.URL + "/v0.2/traces"
+
+	tr.discoverAgent(context.Background())
+
+	if tr.url != srv.URL+"/v0.3/traces" {
+		t.Fatalf("expected discovery to settle on the stable endpoint, got %s", tr.url)
+	}
+	if tr.compatibilityMode {
+		t.Fatalf("expected compatibilityMode to stay false when the stable endpoint is available")
+	}
+}
+
+func TestDiscoverAgentFallsBackWhenInfoUnavailable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	tr := newHTTPTransport(defaultHostname, defaultPort)
+	tr.url = srv.URL + "/v0.3/traces"
+	tr.legacyURL = srv.URL + "/v0.2/traces"
+
+	tr.discoverAgent(context.Background())
+
+	if !strings.HasSuffix(tr.url, "/v0.3/traces") {
+		t.Fatalf("expected the transport to keep its original endpoint when /info 404s, got %s", tr.url)
+	}
+	if tr.compatibilityMode {
+		t.Fatalf("expected compatibilityMode to remain false; the reactive downgrade path owns that decision")
+	}
+}
+
+func TestDiscoverAgentRunsOnlyOnce(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{"endpoints":["/v0.3/traces"]}`))
+	}))
+	defer srv.Close()
+
+	tr := newHTTPTransport(defaultHostname, defaultPort)
+	tr.url = srv.URL + "/v0.3/traces"
+	tr.legacyURL = srv.URL + "/v0.2/traces"
+
+	tr.discoverAgent(context.Background())
+	tr.discoverAgent(context.Background())
+
+	if requests != 1 {
+		t.Fatalf("expected /info to be queried exactly once, got %d requests", requests)
+	}
+}
@@ -0,0 +1,89 @@
+package tracer
+
+import (
+	"fmt"
+	"sync"
+)
+
+// apiVersion ranks a registered encoder relative to the others, from oldest
+// to newest. apiDowngrade uses it to pick the highest-ranked encoder that is
+// still older than the one currently in use.
+const (
+	apiVersionLegacy = iota + 1 // v0.2, JSON
+	apiVersionStable            // v0.3, msgpack and formats built on top of it
+)
+
+// defaultEncoderName is the encoder newHTTPTransport selects by default.
+const defaultEncoderName = "msgpack"
+
+// EncoderFactory constructs a new Encoder instance. Factories are registered
+// under a name with RegisterEncoder so that WithEncoder can select a wire
+// format by name instead of by a fixed integer constant. selectEncoder wraps
+// the factory in a sync.Pool, so it is only invoked to grow the pool, not on
+// every Send.
+type EncoderFactory func() Encoder
+
+// encoderRegistration is a named, pluggable wire format: the Encoder it
+// produces, the Content-Type header to advertise for it, and the API
+// version it targets, so apiDowngrade can find a compatible fallback.
+type encoderRegistration struct {
+	factory     EncoderFactory
+	contentType string
+	apiVersion  int
+}
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[string]encoderRegistration{
+		"json": {
+			factory:     func() Encoder { pool, _ := newEncoderPool(JSON_ENCODER, 1); return pool.Borrow() },
+			contentType: "application/json",
+			apiVersion:  apiVersionLegacy,
+		},
+		"msgpack": {
+			factory:     func() Encoder { pool, _ := newEncoderPool(MSGPACK_ENCODER, 1); return pool.Borrow() },
+			contentType: "application/msgpack",
+			apiVersion:  apiVersionStable,
+		},
+	}
+)
+
+// RegisterEncoder makes a pluggable Encoder implementation available under
+// name for use with WithEncoder. apiVersion ranks it relative to the other
+// registered encoders (see apiVersionLegacy/apiVersionStable); apiDowngrade
+// falls back to the highest-ranked encoder below the one currently in use.
+func RegisterEncoder(name string, apiVersion int, contentType string, factory EncoderFactory) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	encoders[name] = encoderRegistration{factory: factory, contentType: contentType, apiVersion: apiVersion}
+}
+
+// lookupEncoder returns the registration for name, if any.
+func lookupEncoder(name string) (encoderRegistration, bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	reg, ok := encoders[name]
+	return reg, ok
+}
+
+// nextOldestEncoder returns the name of the highest-ranked registered
+// encoder whose apiVersion is strictly below currentVersion, for apiDowngrade
+// to fall back to when the agent doesn't support the current one.
+func nextOldestEncoder(currentVersion int) (name string, reg encoderRegistration, found bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+
+	for candidateName, candidate := range encoders {
+		if candidate.apiVersion >= currentVersion {
+			continue
+		}
+		if !found || candidate.apiVersion > reg.apiVersion {
+			name, reg, found = candidateName, candidate, true
+		}
+	}
+	return name, reg, found
+}
+
+func unknownEncoderError(name string) error {
+	return fmt.Errorf("tracer: unknown encoder %q", name)
+}
@@ -0,0 +1,28 @@
+package tracer
+
+import "testing"
+
+func TestNextOldestEncoderPicksHighestBelowCurrent(t *testing.T) {
+	// ranks above the built-in encoders' so no built-in shares test-middle's
+	// rank, which would make the pick depend on map iteration order
+	RegisterEncoder("test-oldest", 10, "application/x-test-oldest", func() Encoder { return newStreamEncoder() })
+	RegisterEncoder("test-middle", 11, "application/x-test-middle", func() Encoder { return newStreamEncoder() })
+	RegisterEncoder("test-newest", 12, "application/x-test-newest", func() Encoder { return newStreamEncoder() })
+
+	name, reg, found := nextOldestEncoder(12)
+	if !found || name != "test-middle" || reg.apiVersion != 11 {
+		t.Fatalf("expected test-middle (apiVersion 11) below 12, got name=%q reg=%+v found=%v", name, reg, found)
+	}
+}
+
+func TestNextOldestEncoderNoneBelowLowest(t *testing.T) {
+	if _, _, found := nextOldestEncoder(apiVersionLegacy); found {
+		t.Fatalf("expected no encoder below the lowest registered apiVersion")
+	}
+}
+
+func TestLookupEncoderUnknownName(t *testing.T) {
+	if _, ok := lookupEncoder("does-not-exist"); ok {
+		t.Fatalf("expected lookupEncoder to report an unknown encoder as not found")
+	}
+}
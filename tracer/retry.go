@@ -0,0 +1,101 @@
+package tracer
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxBackoff caps the exponential backoff delay computed by retryPolicy.next,
+// regardless of maxAttempts, so a misconfigured retry policy can never stall
+// a flush for an unreasonable amount of time.
+const maxBackoff = 5 * time.Second
+
+// retryPolicy controls how many times, and how long to wait between, a
+// failed send to the agent is retried.
+type retryPolicy struct {
+	maxAttempts    int
+	initialBackoff time.Duration
+}
+
+// defaultRetryPolicy preserves the historical behavior of Transport: a
+// failed Send is not retried.
+var defaultRetryPolicy = retryPolicy{maxAttempts: 1, initialBackoff: 100 * time.Millisecond}
+
+// next returns the delay to wait before the given attempt (1-indexed) is
+// retried: the configured initial backoff doubled once per prior attempt,
+// capped at maxBackoff, plus up to 50% jitter to avoid every tracer in a
+// fleet retrying in lockstep.
+func (p retryPolicy) next(attempt int) time.Duration {
+	backoff := p.initialBackoff << uint(attempt-1)
+	if backoff <= 0 || backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff/2) + 1))
+	return backoff + jitter
+}
+
+// bufferedPayload is an encoded trace payload held by a payloadBuffer,
+// tagged with the URL and Content-Type it was encoded for at the time it
+// was buffered. The transport's url/encoder can change between when a
+// payload is buffered and when it's retried (an API downgrade or agent
+// discovery switching endpoints), so flushBuffer must replay each payload
+// against the endpoint/format it actually matches rather than whatever is
+// currently active.
+type bufferedPayload struct {
+	payload     []byte
+	url         string
+	contentType string
+}
+
+// payloadBuffer is a bounded FIFO buffer of encoded trace payloads, used to
+// hold spans in memory while the agent is transiently unavailable rather
+// than dropping them outright. Once the byte budget is exceeded, the oldest
+// payloads are dropped to make room for new ones.
+type payloadBuffer struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	payloads []bufferedPayload
+}
+
+// newPayloadBuffer returns a payloadBuffer that holds at most maxBytes worth
+// of encoded payloads.
+func newPayloadBuffer(maxBytes int) *payloadBuffer {
+	return &payloadBuffer{maxBytes: maxBytes}
+}
+
+// push appends payload, tagged with the url/contentType it was encoded for,
+// to the buffer, dropping the oldest buffered payloads first if necessary to
+// stay within maxBytes. A payload larger than maxBytes on its own is
+// rejected outright, before anything already buffered is evicted to make
+// room for it.
+func (b *payloadBuffer) push(payload []byte, url, contentType string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(payload) > b.maxBytes {
+		log.Printf("dd-trace: dropping %d byte payload, larger than the %d byte trace buffer\n", len(payload), b.maxBytes)
+		return
+	}
+	for b.size+len(payload) > b.maxBytes && len(b.payloads) > 0 {
+		dropped := b.payloads[0]
+		b.payloads = b.payloads[1:]
+		b.size -= len(dropped.payload)
+		log.Printf("dd-trace: trace buffer full, dropping %d bytes of buffered spans\n", len(dropped.payload))
+	}
+	b.payloads = append(b.payloads, bufferedPayload{payload: payload, url: url, contentType: contentType})
+	b.size += len(payload)
+}
+
+// drain removes and returns every payload currently held in the buffer.
+func (b *payloadBuffer) drain() []bufferedPayload {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	payloads := b.payloads
+	b.payloads = nil
+	b.size = 0
+	return payloads
+}
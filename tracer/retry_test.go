@@ -0,0 +1,56 @@
+package tracer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPayloadBufferOversizedPayloadDoesNotEvictExisting(t *testing.T) {
+	buf := newPayloadBuffer(10)
+	buf.push([]byte("12345"), "http://agent/v0.3/traces", "application/msgpack")
+
+	buf.push([]byte("this payload alone is far larger than ten bytes"), "http://agent/v0.3/traces", "application/msgpack")
+
+	got := buf.drain()
+	if len(got) != 1 || string(got[0].payload) != "12345" {
+		t.Fatalf("expected the original payload to survive an oversized push, got %v", got)
+	}
+}
+
+func TestPayloadBufferEvictsOldestWhenFull(t *testing.T) {
+	buf := newPayloadBuffer(10)
+	buf.push([]byte("12345"), "http://agent/v0.3/traces", "application/msgpack")
+	buf.push([]byte("67890"), "http://agent/v0.3/traces", "application/msgpack")
+	buf.push([]byte("abcde"), "http://agent/v0.3/traces", "application/msgpack") // should evict "12345"
+
+	got := buf.drain()
+	if len(got) != 2 || string(got[0].payload) != "67890" || string(got[1].payload) != "abcde" {
+		t.Fatalf("expected oldest payload to be evicted, got %v", got)
+	}
+}
+
+func TestPayloadBufferTagsPayloadWithItsEncodingTarget(t *testing.T) {
+	buf := newPayloadBuffer(100)
+	buf.push([]byte("legacy-payload"), "http://agent/v0.2/traces", "application/json")
+	buf.push([]byte("stable-payload"), "http://agent/v0.3/traces", "application/msgpack")
+
+	got := buf.drain()
+	if len(got) != 2 {
+		t.Fatalf("expected 2 buffered payloads, got %d", len(got))
+	}
+	if got[0].url != "http://agent/v0.2/traces" || got[0].contentType != "application/json" {
+		t.Fatalf("expected first payload tagged with the legacy endpoint, got %+v", got[0])
+	}
+	if got[1].url != "http://agent/v0.3/traces" || got[1].contentType != "application/msgpack" {
+		t.Fatalf("expected second payload tagged with the stable endpoint, got %+v", got[1])
+	}
+}
+
+func TestRetryPolicyNextCapsAtMaxBackoff(t *testing.T) {
+	p := retryPolicy{maxAttempts: 10, initialBackoff: time.Second}
+	for attempt := 1; attempt <= 10; attempt++ {
+		if d := p.next(attempt); d > maxBackoff+maxBackoff/2 {
+			t.Fatalf("attempt %d: backoff %s exceeded maxBackoff+jitter bound", attempt, d)
+		}
+	}
+}
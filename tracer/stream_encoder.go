@@ -0,0 +1,51 @@
+package tracer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+)
+
+func init() {
+	RegisterEncoder("stream", apiVersionStable, "application/vnd.datadog.trace-stream+json", newStreamEncoder)
+}
+
+// streamEncoder implements Encoder by writing each trace as an independent,
+// length-prefixed JSON frame, rather than marshaling the whole batch as a
+// single JSON array, so a reader could in principle consume traces one frame
+// at a time instead of needing the entire body parsed before the first trace
+// is available. It does not currently reduce peak memory during a Send:
+// httpTransport reads the full encoded payload into a []byte up front (via
+// ioutil.ReadAll) so it has stable bytes to retry and buffer on transient
+// failures, so this buffers the whole batch just like msgpack/json do.
+type streamEncoder struct {
+	buf bytes.Buffer
+}
+
+func newStreamEncoder() Encoder {
+	return &streamEncoder{}
+}
+
+// Encode appends each trace to the buffer as its own 4-byte big-endian
+// length prefix followed by its JSON encoding.
+func (e *streamEncoder) Encode(traces [][]*Span) error {
+	for _, trace := range traces {
+		data, err := json.Marshal(trace)
+		if err != nil {
+			return err
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+		e.buf.Write(length[:])
+		e.buf.Write(data)
+	}
+	return nil
+}
+
+func (e *streamEncoder) Read(p []byte) (int, error) {
+	return e.buf.Read(p)
+}
+
+func (e *streamEncoder) Reset() {
+	e.buf.Reset()
+}
@@ -1,25 +1,39 @@
 package tracer
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	defaultHostname    = "localhost"
 	defaultPort        = "7777"
-	defaultEncoder     = MSGPACK_ENCODER // defines the default encoder used when the Transport is initialized
-	legacyEncoder      = JSON_ENCODER    // defines the legacy encoder used with earlier agent versions
-	defaultHTTPTimeout = time.Second     // defines the current timeout before giving up with the send process
-	encoderPoolSize    = 5               // how many encoders are available
+	defaultHTTPTimeout = time.Second // defines the current timeout before giving up with the send process
+)
+
+// environment variables used to configure a Transport via FromEnv.
+const (
+	envAgentHost    = "DD_AGENT_HOST"
+	envAgentPort    = "DD_TRACE_AGENT_PORT"
+	envAgentURL     = "DD_TRACE_AGENT_URL"
+	envAgentTimeout = "DD_TRACE_AGENT_TIMEOUT"
 )
 
 // Transport is an interface for span submission to the agent.
 type Transport interface {
 	Send(spans [][]*Span) (*http.Response, error)
+	SendWithContext(ctx context.Context, spans [][]*Span) (*http.Response, error)
 	SetHeader(key, value string)
 }
 
@@ -30,106 +44,499 @@ type Transport interface {
 //
 // In general, using this method is only necessary if you have a trace agent
 // running on a non-default port or if it's located on another machine.
+//
+// Deprecated: use NewTransportWithOpts with WithAddress instead.
 func NewTransport(hostname, port string) Transport {
-	if hostname == "" {
-		hostname = defaultHostname
-	}
-	if port == "" {
-		port = defaultPort
+	t, err := NewTransportWithOpts(WithAddress(hostname, port))
+	if err != nil {
+		// WithAddress never returns an error, so this is unreachable.
+		panic(err)
 	}
-	return newHTTPTransport(hostname, port)
+	return t
 }
 
 // newDefaultTransport return a default transport for this tracing client
 func newDefaultTransport() Transport {
-	return newHTTPTransport(defaultHostname, defaultPort)
+	t, err := NewTransportWithOpts()
+	if err != nil {
+		// no options are applied, so construction cannot fail.
+		panic(err)
+	}
+	return t
 }
 
 type httpTransport struct {
 	url               string            // the delivery URL
 	legacyURL         string            // legacy delivery URL
-	pool              *encoderPool      // encoding allocates lot of buffers (which might then be resized) so we use a pool so they can be re-used
 	client            *http.Client      // the HTTP client used in the POST
+	ownsClient        bool              // whether t.client is a private copy safe to mutate, false once WithHTTPClient supplies one
 	headers           map[string]string // the Transport headers
 	compatibilityMode bool              // the Agent targets a legacy API for compatibility reasons
+
+	hostname string // the agent hostname last set by newHTTPTransport or an address option; not updated by WithUnixSocket
+	port     string // the agent port last set by newHTTPTransport or an address option; not updated by WithUnixSocket
+
+	encoderName    string     // the registered encoder name currently selected, e.g. "msgpack"
+	encoderVersion int        // the apiVersion of the encoder currently selected, used to find a downgrade target
+	encoderPool    *sync.Pool // reuses Encoders (and their buffers) for the registration backing encoderName, swapped by selectEncoder
+
+	retry  retryPolicy    // governs retries of transient send failures, set by WithRetryPolicy
+	buffer *payloadBuffer // holds payloads across transient failures so spans aren't dropped, set by WithBuffer
+
+	discoveryEnabled bool      // whether to negotiate the endpoint/encoder via /info before the first Send, set by WithAgentDiscovery
+	discoverOnce     sync.Once // ensures discoverAgent only ever queries /info once
+}
+
+// TransportOption represents an option that can be passed to NewTransportWithOpts
+// to customize the resulting Transport.
+type TransportOption func(*httpTransport) error
+
+// NewTransportWithOpts returns a new Transport configured with the given
+// TransportOptions, following the same functional-options pattern used by
+// Docker's client.NewClientWithOpts. With no options, it behaves exactly like
+// the previous zero-value NewTransport(defaultHostname, defaultPort).
+func NewTransportWithOpts(opts ...TransportOption) (Transport, error) {
+	t := newHTTPTransport(defaultHostname, defaultPort)
+	for _, opt := range opts {
+		if err := opt(t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// WithAddress configures the Transport to send traces to the trace agent
+// running on the given hostname and port over HTTP. If the zero values for
+// hostname and port are provided, the default values will be used
+// ("localhost" for hostname, and "7777" for port). To speak HTTPS to the
+// agent instead, use FromEnv with an "https://" DD_TRACE_AGENT_URL.
+func WithAddress(hostname, port string) TransportOption {
+	return withAddressScheme("http", hostname, port)
+}
+
+// withAddressScheme is the shared implementation behind WithAddress and the
+// scheme-aware branches of parseAgentURL, so both build the delivery URLs
+// the same way and differ only in scheme.
+func withAddressScheme(scheme, hostname, port string) TransportOption {
+	return func(t *httpTransport) error {
+		if hostname == "" {
+			hostname = defaultHostname
+		}
+		if port == "" {
+			port = defaultPort
+		}
+		t.hostname = hostname
+		t.port = port
+		t.url = fmt.Sprintf("%s://%s:%s/v0.3/traces", scheme, hostname, port)
+		t.legacyURL = fmt.Sprintf("%s://%s:%s/v0.2/traces", scheme, hostname, port)
+		return nil
+	}
+}
+
+// WithHTTPClient configures the Transport to use the given *http.Client to
+// submit traces to the agent, instead of the default client.
+func WithHTTPClient(client *http.Client) TransportOption {
+	return func(t *httpTransport) error {
+		if client == nil {
+			return errors.New("WithHTTPClient: client must not be nil")
+		}
+		t.client = client
+		t.ownsClient = false
+		return nil
+	}
+}
+
+// WithTimeout configures the timeout used by the Transport's HTTP client when
+// submitting traces to the agent.
+func WithTimeout(timeout time.Duration) TransportOption {
+	return func(t *httpTransport) error {
+		t.ensureOwnClient()
+		t.client.Timeout = timeout
+		return nil
+	}
+}
+
+// WithEncoder configures the encoder used to serialize traces before they are
+// submitted to the agent. name must have been registered with RegisterEncoder;
+// the built-in "msgpack" (the default) and "json" encoders are always
+// available.
+func WithEncoder(name string) TransportOption {
+	return func(t *httpTransport) error {
+		return t.selectEncoder(name)
+	}
+}
+
+// WithHeaders configures additional headers to be sent with every request to
+// the agent. Headers already set on the Transport (such as Content-Type) are
+// overwritten if present in headers.
+func WithHeaders(headers map[string]string) TransportOption {
+	return func(t *httpTransport) error {
+		for k, v := range headers {
+			t.headers[k] = v
+		}
+		return nil
+	}
+}
+
+// WithUnixSocket configures the Transport to submit traces to the trace agent
+// over the Unix domain socket at path, instead of over TCP. This mirrors how
+// the Docker client handles "unix://" endpoints: the client's Transport gets
+// a DialContext that always dials the socket, regardless of the address in
+// the request URL, and the request URL itself is rewritten to a fixed
+// "http://unix/..." host so the standard http.Client machinery is otherwise
+// unaffected.
+func WithUnixSocket(path string) TransportOption {
+	return func(t *httpTransport) error {
+		if path == "" {
+			return errors.New("WithUnixSocket: path must not be empty")
+		}
+		t.url = "http://unix/v0.3/traces"
+		t.legacyURL = "http://unix/v0.2/traces"
+		t.ensureOwnClient()
+		transport := t.cloneTransport()
+		transport.DialContext = func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		}
+		t.client.Transport = transport
+		return nil
+	}
+}
+
+// WithTLSConfig configures the TLS settings used when the Transport connects
+// to the agent over HTTPS.
+func WithTLSConfig(cfg *tls.Config) TransportOption {
+	return func(t *httpTransport) error {
+		t.ensureOwnClient()
+		transport := t.cloneTransport()
+		transport.TLSClientConfig = cfg
+		t.client.Transport = transport
+		return nil
+	}
+}
+
+// ensureOwnClient makes t.client a private copy if it isn't already one, so
+// that options like WithUnixSocket and WithTLSConfig never mutate a
+// *http.Client the caller supplied via WithHTTPClient (and may still be
+// using elsewhere) in place.
+func (t *httpTransport) ensureOwnClient() {
+	if t.ownsClient {
+		return
+	}
+	clone := *t.client
+	t.client = &clone
+	t.ownsClient = true
+}
+
+// cloneTransport returns an *http.Transport seeded from t.client's current
+// RoundTripper, so options that only care about one setting (the dialer, the
+// TLS config) can layer it on without discarding whatever the other already
+// configured, and without mutating a *http.Transport the caller might still
+// hold a reference to.
+func (t *httpTransport) cloneTransport() *http.Transport {
+	if transport, ok := t.client.Transport.(*http.Transport); ok && transport != nil {
+		return transport.Clone()
+	}
+	return &http.Transport{}
+}
+
+// WithRetryPolicy configures the Transport to retry a failed send up to
+// maxAttempts times, using exponential backoff starting at initialBackoff
+// (doubling on each subsequent attempt, capped at a few seconds, plus
+// jitter). Only network errors and 5xx agent responses are retried; 4xx
+// responses other than 404/415 (which trigger an API downgrade instead) are
+// considered non-transient and are never retried.
+func WithRetryPolicy(maxAttempts int, initialBackoff time.Duration) TransportOption {
+	return func(t *httpTransport) error {
+		if maxAttempts < 1 {
+			return errors.New("WithRetryPolicy: maxAttempts must be at least 1")
+		}
+		t.retry = retryPolicy{maxAttempts: maxAttempts, initialBackoff: initialBackoff}
+		return nil
+	}
+}
+
+// WithBuffer configures the Transport to hold up to maxBytes worth of
+// encoded payloads in memory when the agent is unreachable, instead of
+// dropping them. Buffered payloads are retried on the next call to Send or
+// SendWithContext; if the buffer fills up, the oldest payloads are dropped
+// to make room.
+func WithBuffer(maxBytes int) TransportOption {
+	return func(t *httpTransport) error {
+		if maxBytes < 1 {
+			return errors.New("WithBuffer: maxBytes must be at least 1")
+		}
+		t.buffer = newPayloadBuffer(maxBytes)
+		return nil
+	}
+}
+
+// WithAgentDiscovery controls whether the Transport negotiates its endpoint
+// and encoder with the agent's /info endpoint before the first Send. It is
+// enabled by default; tests and environments that stub out only the trace
+// endpoints (and not /info) should disable it with WithAgentDiscovery(false).
+func WithAgentDiscovery(enabled bool) TransportOption {
+	return func(t *httpTransport) error {
+		t.discoveryEnabled = enabled
+		return nil
+	}
+}
+
+// FromEnv configures the Transport using the standard Datadog agent
+// environment variables, allowing containerized deployments to target the
+// agent without any code changes:
+//
+//	DD_AGENT_HOST           the agent hostname (e.g. "datadog-agent")
+//	DD_TRACE_AGENT_PORT     the agent trace port (e.g. "8126")
+//	DD_TRACE_AGENT_URL      a full agent address, takes precedence over
+//	                        DD_AGENT_HOST/DD_TRACE_AGENT_PORT. Accepts
+//	                        "host:port", "http(s)://host:port", or
+//	                        "unix:///path/to/socket"
+//	DD_TRACE_AGENT_TIMEOUT  a time.Duration string (e.g. "2s") for the HTTP
+//	                        client timeout
+func FromEnv() TransportOption {
+	return func(t *httpTransport) error {
+		if url := os.Getenv(envAgentURL); url != "" {
+			opt, err := parseAgentURL(url)
+			if err != nil {
+				return fmt.Errorf("FromEnv: invalid %s: %v", envAgentURL, err)
+			}
+			if err := opt(t); err != nil {
+				return err
+			}
+		} else if hostname, port := os.Getenv(envAgentHost), os.Getenv(envAgentPort); hostname != "" || port != "" {
+			if err := WithAddress(hostname, port)(t); err != nil {
+				return err
+			}
+		}
+		if v := os.Getenv(envAgentTimeout); v != "" {
+			timeout, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("FromEnv: invalid %s: %v", envAgentTimeout, err)
+			}
+			if err := WithTimeout(timeout)(t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// parseAgentURL parses a DD_TRACE_AGENT_URL value into the TransportOption
+// that configures the equivalent endpoint: WithUnixSocket for a
+// "unix:///path" URL, or an address option for a "host:port" address
+// (optionally prefixed with "http://" or "https://"). The scheme, if any, is
+// preserved into the resulting delivery URL rather than discarded, so an
+// "https://" address is actually spoken over TLS (pair it with
+// WithTLSConfig to control the TLS settings used).
+func parseAgentURL(url string) (TransportOption, error) {
+	if path := strings.TrimPrefix(url, "unix://"); path != url {
+		if path == "" {
+			return nil, fmt.Errorf("unix socket URL %q is missing a path", url)
+		}
+		return WithUnixSocket(path), nil
+	}
+	scheme := "http"
+	switch {
+	case strings.HasPrefix(url, "https://"):
+		scheme = "https"
+		url = strings.TrimPrefix(url, "https://")
+	case strings.HasPrefix(url, "http://"):
+		url = strings.TrimPrefix(url, "http://")
+	}
+	host, port, err := net.SplitHostPort(url)
+	if err != nil {
+		return nil, err
+	}
+	return withAddressScheme(scheme, host, port), nil
 }
 
 // newHTTPTransport returns an httpTransport for the given endpoint
 func newHTTPTransport(hostname, port string) *httpTransport {
-	// initialize the default EncoderPool with Encoder headers
-	pool, contentType := newEncoderPool(defaultEncoder, encoderPoolSize)
-	defaultHeaders := make(map[string]string)
-	defaultHeaders["Content-Type"] = contentType
-
-	return &httpTransport{
+	t := &httpTransport{
 		url:       fmt.Sprintf("http://%s:%s/v0.3/traces", hostname, port),
 		legacyURL: fmt.Sprintf("http://%s:%s/v0.2/traces", hostname, port),
-		pool:      pool,
 		client: &http.Client{
 			Timeout: defaultHTTPTimeout,
 		},
-		headers:           defaultHeaders,
+		ownsClient:        true,
+		headers:           make(map[string]string),
 		compatibilityMode: false,
+		hostname:          hostname,
+		port:              port,
+		retry:             defaultRetryPolicy,
+		discoveryEnabled:  true,
+	}
+	if err := t.selectEncoder(defaultEncoderName); err != nil {
+		// defaultEncoderName is always registered; this can't happen.
+		panic(err)
 	}
+	return t
 }
 
+// Send implements Transport.
 func (t *httpTransport) Send(traces [][]*Span) (*http.Response, error) {
+	return t.SendWithContext(context.Background(), traces)
+}
+
+// SendWithContext implements Transport. The given ctx bounds the entire
+// send, including any retries and the request performed after an API
+// downgrade, so a caller flushing on shutdown can rely on its deadline being
+// honored end-to-end. Transient failures (network errors, 5xx responses) are
+// retried per the configured retryPolicy; if every attempt fails and a
+// payloadBuffer is configured, the encoded payload is buffered and retried
+// on a future call instead of being dropped.
+func (t *httpTransport) SendWithContext(ctx context.Context, traces [][]*Span) (*http.Response, error) {
 	if t.url == "" {
 		return nil, errors.New("provided an empty URL, giving up")
 	}
 
-	// borrow an encoder
-	encoder := t.pool.Borrow()
-	defer t.pool.Return(encoder)
+	t.discoverAgent(ctx)
+	t.flushBuffer(ctx)
 
-	// encode the spans and return the error if any
+	encoder := t.encoderPool.Get().(Encoder)
 	err := encoder.Encode(traces)
+	var payload []byte
+	if err == nil {
+		payload, err = ioutil.ReadAll(encoder)
+	}
+	if resettable, ok := encoder.(interface{ Reset() }); ok {
+		resettable.Reset()
+	}
+	t.encoderPool.Put(encoder)
 	if err != nil {
 		return nil, err
 	}
 
-	// prepare the client and send the payload
-	req, _ := http.NewRequest("POST", t.url, encoder)
-	for header, value := range t.headers {
-		req.Header.Set(header, value)
+	response, err := t.postWithRetry(ctx, payload)
+
+	// if we got a 404 we should downgrade the API to a stable version (at most once) and
+	// resend, since the payload above was encoded for the API version we just left
+	if response != nil && (response.StatusCode == 404 || response.StatusCode == 415) && !t.compatibilityMode {
+		log.Printf("calling the endpoint '%s' but received %d; downgrading the API\n", t.url, response.StatusCode)
+		response.Body.Close()
+		t.apiDowngrade()
+		return t.SendWithContext(ctx, traces)
 	}
-	response, err := t.client.Do(req)
 
-	// if we have an error, return an empty Response to protect against nil pointer dereference
-	if err != nil {
-		return &http.Response{StatusCode: 0}, err
+	if err != nil && t.buffer != nil {
+		t.buffer.push(payload, t.url, t.headers["Content-Type"])
 	}
+	return response, err
+}
 
-	// if we got a 404 we should downgrade the API to a stable version (at most once)
-	if (response.StatusCode == 404 || response.StatusCode == 415) && !t.compatibilityMode {
-		log.Printf("calling the endpoint '%s' but received %d; downgrading the API\n", t.url, response.StatusCode)
-		t.apiDowngrade()
-		return t.Send(traces)
+// postWithRetry POSTs payload to t.url, retrying transient failures (network
+// errors and 5xx responses) per t.retry. A non-transient 4xx response (other
+// than 404/415, which the caller handles as an API downgrade) is returned
+// immediately without being retried.
+func (t *httpTransport) postWithRetry(ctx context.Context, payload []byte) (*http.Response, error) {
+	maxAttempts := t.retry.maxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
 	}
 
-	response.Body.Close()
+	var response *http.Response
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		response, err = t.post(ctx, t.url, t.headers["Content-Type"], payload)
+		if err == nil && response.StatusCode < 500 {
+			// outside compatibility mode a 404/415 body is left open here; the
+			// caller closes it before downgrading and resending. Every other
+			// response is done with its body immediately.
+			if (response.StatusCode != 404 && response.StatusCode != 415) || t.compatibilityMode {
+				response.Body.Close()
+			}
+			return response, nil
+		}
+		if err == nil {
+			response.Body.Close()
+			err = fmt.Errorf("agent responded with status %d", response.StatusCode)
+		}
+		if attempt == maxAttempts {
+			break
+		}
+		select {
+		case <-time.After(t.retry.next(attempt)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	// protect callers against nil pointer dereferences on a network error
+	if response == nil {
+		response = &http.Response{StatusCode: 0}
+	}
 	return response, err
 }
 
+// post sends a single POST request carrying payload to url, with Content-Type
+// overridden to contentType (which may differ from the transport's current
+// t.headers["Content-Type"] when replaying a buffered payload encoded for a
+// since-abandoned endpoint/format).
+func (t *httpTransport) post(ctx context.Context, url, contentType string, payload []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	for header, value := range t.headers {
+		req.Header.Set(header, value)
+	}
+	req.Header.Set("Content-Type", contentType)
+	return t.client.Do(req)
+}
+
+// flushBuffer retries any payloads held from previous transient failures,
+// replaying each against the URL/Content-Type it was originally encoded
+// for rather than the transport's current ones, since an API downgrade or
+// agent discovery may have switched endpoints or encoders in the meantime.
+// Payloads that still can't be delivered are pushed back onto the buffer.
+func (t *httpTransport) flushBuffer(ctx context.Context) {
+	if t.buffer == nil {
+		return
+	}
+	for _, buffered := range t.buffer.drain() {
+		response, err := t.post(ctx, buffered.url, buffered.contentType, buffered.payload)
+		if err != nil || response.StatusCode >= 500 {
+			t.buffer.push(buffered.payload, buffered.url, buffered.contentType)
+			continue
+		}
+		response.Body.Close()
+	}
+}
+
 // SetHeader sets the internal header for the httpTransport
 func (t *httpTransport) SetHeader(key, value string) {
 	t.headers[key] = value
 }
 
-// changeEncoder switches the internal encoders pool so that a different API with different
-// format can be targeted, preventing failures because of outdated agents
-func (t *httpTransport) changeEncoder(encoderType int) {
-	pool, contentType := newEncoderPool(encoderType, encoderPoolSize)
-	t.pool = pool
-	t.headers["Content-Type"] = contentType
+// selectEncoder switches the transport to the encoder registered under name,
+// so that a different wire format can be targeted, e.g. to avoid failures
+// against an outdated agent. It installs a fresh encoderPool seeded from the
+// registration's factory, so that Sends against the new encoder reuse their
+// own Encoders (and underlying buffers) instead of allocating one per Send.
+func (t *httpTransport) selectEncoder(name string) error {
+	reg, ok := lookupEncoder(name)
+	if !ok {
+		return unknownEncoderError(name)
+	}
+	factory := reg.factory
+	t.encoderName = name
+	t.encoderVersion = reg.apiVersion
+	t.encoderPool = &sync.Pool{New: func() interface{} { return factory() }}
+	t.headers["Content-Type"] = reg.contentType
+	return nil
 }
 
-// apiDowngrade downgrades the used encoder and API level. This method must fallback to a safe
-// encoder and API, so that it will success despite users' configurations. This action
-// ensures that the compatibility mode is activated so that the downgrade will be
-// executed only once.
+// apiDowngrade downgrades the used encoder and API level. It consults the
+// encoder registry for the highest-ranked encoder older than the one
+// currently in use, rather than hard-coding a single legacy fallback, so
+// that adding new encoders/API versions doesn't require touching this
+// method. This method must fallback to a safe encoder and API, so that it
+// will succeed despite users' configurations. This action ensures that the
+// compatibility mode is activated so that the downgrade will be executed
+// only once.
 func (t *httpTransport) apiDowngrade() {
 	t.compatibilityMode = true
 	t.url = t.legacyURL
-	t.changeEncoder(legacyEncoder)
+	if name, _, ok := nextOldestEncoder(t.encoderVersion); ok {
+		t.selectEncoder(name)
+	}
 }
@@ -0,0 +1,90 @@
+package tracer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseAgentURL(t *testing.T) {
+	cases := []struct {
+		url        string
+		wantURL    string
+		wantSocket bool
+	}{
+		{"localhost:8126", "http://localhost:8126/v0.3/traces", false},
+		{"http://localhost:8126", "http://localhost:8126/v0.3/traces", false},
+		{"https://localhost:8126", "https://localhost:8126/v0.3/traces", false},
+		{"unix:///var/run/datadog/apm.socket", "http://unix/v0.3/traces", true},
+	}
+	for _, c := range cases {
+		opt, err := parseAgentURL(c.url)
+		if err != nil {
+			t.Fatalf("parseAgentURL(%q): unexpected error: %v", c.url, err)
+		}
+		tr := newHTTPTransport(defaultHostname, defaultPort)
+		if err := opt(tr); err != nil {
+			t.Fatalf("parseAgentURL(%q): option application failed: %v", c.url, err)
+		}
+		if tr.url != c.wantURL {
+			t.Fatalf("parseAgentURL(%q): got url %q, want %q", c.url, tr.url, c.wantURL)
+		}
+	}
+}
+
+func TestParseAgentURLRejectsMalformed(t *testing.T) {
+	for _, url := range []string{"unix://", "not-a-host-port"} {
+		if _, err := parseAgentURL(url); err == nil {
+			t.Fatalf("parseAgentURL(%q): expected an error, got none", url)
+		}
+	}
+}
+
+func TestWithUnixSocketPreservesTLSConfig(t *testing.T) {
+	tr := newHTTPTransport(defaultHostname, defaultPort)
+	if err := WithTLSConfig(&tls.Config{ServerName: "agent"})(tr); err != nil {
+		t.Fatalf("WithTLSConfig: %v", err)
+	}
+	if err := WithUnixSocket("/tmp/apm.socket")(tr); err != nil {
+		t.Fatalf("WithUnixSocket: %v", err)
+	}
+	transport, ok := tr.client.Transport.(*http.Transport)
+	if !ok || transport.DialContext == nil {
+		t.Fatalf("expected WithUnixSocket to configure a dialer, got %#v", tr.client.Transport)
+	}
+	if transport.TLSClientConfig == nil || transport.TLSClientConfig.ServerName != "agent" {
+		t.Fatalf("expected WithUnixSocket to keep the TLS config set by WithTLSConfig, got %#v", transport.TLSClientConfig)
+	}
+}
+
+func TestWithUnixSocketDoesNotMutateCallerClient(t *testing.T) {
+	shared := &http.Client{}
+	tr := newHTTPTransport(defaultHostname, defaultPort)
+	if err := WithHTTPClient(shared)(tr); err != nil {
+		t.Fatalf("WithHTTPClient: %v", err)
+	}
+	if err := WithUnixSocket("/tmp/apm.socket")(tr); err != nil {
+		t.Fatalf("WithUnixSocket: %v", err)
+	}
+	if shared.Transport != nil {
+		t.Fatalf("expected the caller's shared client to be left untouched, got Transport %#v", shared.Transport)
+	}
+}
+
+func TestWithTimeoutDoesNotMutateCallerClient(t *testing.T) {
+	shared := &http.Client{Timeout: time.Minute}
+	tr := newHTTPTransport(defaultHostname, defaultPort)
+	if err := WithHTTPClient(shared)(tr); err != nil {
+		t.Fatalf("WithHTTPClient: %v", err)
+	}
+	if err := WithTimeout(5 * time.Second)(tr); err != nil {
+		t.Fatalf("WithTimeout: %v", err)
+	}
+	if shared.Timeout != time.Minute {
+		t.Fatalf("expected the caller's shared client's Timeout to be left untouched, got %s", shared.Timeout)
+	}
+	if tr.client.Timeout != 5*time.Second {
+		t.Fatalf("expected the transport's own client to have the configured Timeout, got %s", tr.client.Timeout)
+	}
+}